@@ -0,0 +1,410 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+// loadgen drives the whip-whep example server with synthetic publishers and
+// subscribers so the room/SFU fan-out can be validated under load before
+// relying on it in production.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec/vpx"
+	_ "github.com/pion/mediadevices/pkg/driver/screen"
+	webrtc "github.com/pion/webrtc/v4"
+)
+
+// metricsGracePeriod is how long main keeps the process (and serveMetrics'
+// goroutine) alive after report() once -metrics-addr is set, so a scraper
+// has a real window to pull loadgen_sessions_succeeded/_failed before exit.
+const metricsGracePeriod = 15 * time.Second
+
+// nolint: gochecknoglobals
+var (
+	serverURL    = flag.String("server", "http://localhost:8080", "base URL of the whip-whep example server")
+	numRooms     = flag.Int("publishers", 1, "number of rooms to publish into concurrently (one publisher each)")
+	subsPerRoom  = flag.Int("subscribers", 1, "number of WHEP subscribers to open per room")
+	testDuration = flag.Duration("duration", 30*time.Second, "how long to hold sessions open before tearing them down")
+	metricsAddr  = flag.String("metrics-addr", "", "if set, serve Prometheus metrics on this address (e.g. :9100) until the run completes")
+	issuerSecret = flag.String("token-issuer-secret", "", "TOKEN_ISSUER_SECRET configured on the server, sent so fetchToken can mint tokens")
+)
+
+// sessionMetrics is what we measure for a single WHIP or WHEP session.
+type sessionMetrics struct {
+	kind            string // "publish" or "subscribe"
+	connectLatency  time.Duration
+	firstRTPLatency time.Duration // subscribers only; zero for publishers
+	packetsLost     int64
+	jitter          float64
+	err             error
+}
+
+func main() {
+	flag.Parse()
+
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
+	results := make(chan sessionMetrics, *numRooms*(1+*subsPerRoom))
+	var wg sync.WaitGroup
+
+	for i := 0; i < *numRooms; i++ {
+		roomID := uuid.New().String()
+		wg.Add(1)
+		go func(roomID string) {
+			defer wg.Done()
+			runRoom(roomID, results)
+		}(roomID)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	report(results)
+
+	if *metricsAddr != "" {
+		log.Printf("holding %s open for %s so a scraper can read the final counts", *metricsAddr, metricsGracePeriod)
+		time.Sleep(metricsGracePeriod)
+	}
+}
+
+// runRoom publishes one synthetic stream into roomID and attaches
+// subsPerRoom WHEP subscribers to it, holding everything open for
+// testDuration before tearing it down.
+func runRoom(roomID string, results chan<- sessionMetrics) {
+	var subscribersWG sync.WaitGroup
+	ready := make(chan struct{})
+
+	subscribersWG.Add(*subsPerRoom)
+	for i := 0; i < *subsPerRoom; i++ {
+		go func() {
+			defer subscribersWG.Done()
+			<-ready
+			results <- runSubscriber(roomID)
+		}()
+	}
+
+	metrics, publisherConn := runPublisher(roomID)
+	results <- metrics
+	close(ready)
+
+	time.Sleep(*testDuration)
+
+	if publisherConn != nil {
+		_ = publisherConn.Close()
+	}
+	subscribersWG.Wait()
+}
+
+// runPublisher opens a screen-capture WHIP session in roomID and returns
+// the measured connect latency along with the PeerConnection, so the
+// caller can close it once the test duration elapses.
+func runPublisher(roomID string) (sessionMetrics, *webrtc.PeerConnection) {
+	metrics := sessionMetrics{kind: "publish"}
+	start := time.Now()
+
+	token, err := fetchToken(roomID, "publish")
+	if err != nil {
+		metrics.err = fmt.Errorf("fetch publish token: %w", err)
+		return metrics, nil
+	}
+
+	codecSelector := mediadevices.NewCodecSelector(
+		mediadevices.WithVideoEncoders(&vpx.Params{BitRate: 500_000}),
+	)
+
+	mediaEngine := &webrtc.MediaEngine{}
+	codecSelector.Populate(mediaEngine)
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+
+	stream, err := mediadevices.GetDisplayMedia(mediadevices.MediaStreamConstraints{
+		Video: func(c *mediadevices.MediaTrackConstraints) {},
+		Codec: codecSelector,
+	})
+	if err != nil {
+		metrics.err = fmt.Errorf("open screen capture: %w", err)
+		return metrics, nil
+	}
+
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		metrics.err = fmt.Errorf("new peer connection: %w", err)
+		return metrics, nil
+	}
+
+	for _, track := range stream.GetTracks() {
+		if _, err = peerConnection.AddTransceiverFromTrack(track); err != nil {
+			metrics.err = fmt.Errorf("add track: %w", err)
+			return metrics, peerConnection
+		}
+	}
+
+	if err = negotiateWHIP(peerConnection, roomID, token); err != nil {
+		metrics.err = fmt.Errorf("negotiate WHIP: %w", err)
+		return metrics, peerConnection
+	}
+
+	metrics.connectLatency = time.Since(start)
+	return metrics, peerConnection
+}
+
+// runSubscriber opens a recvonly WHEP session in roomID, measuring the time
+// to connect and to receive the first RTP packet, then samples packet
+// loss/jitter from GetStats just before it tears the session down.
+func runSubscriber(roomID string) sessionMetrics {
+	metrics := sessionMetrics{kind: "subscribe"}
+	start := time.Now()
+
+	token, err := fetchToken(roomID, "subscribe")
+	if err != nil {
+		metrics.err = fmt.Errorf("fetch subscribe token: %w", err)
+		return metrics
+	}
+
+	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		metrics.err = fmt.Errorf("new peer connection: %w", err)
+		return metrics
+	}
+	defer peerConnection.Close() //nolint: errcheck
+
+	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		metrics.err = fmt.Errorf("add audio transceiver: %w", err)
+		return metrics
+	}
+	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		metrics.err = fmt.Errorf("add video transceiver: %w", err)
+		return metrics
+	}
+
+	var firstRTPOnce sync.Once
+	firstRTP := make(chan struct{})
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) { //nolint: revive
+		go func() {
+			if _, _, err := track.ReadRTP(); err == nil {
+				firstRTPOnce.Do(func() { close(firstRTP) })
+			}
+			for {
+				if _, _, err := track.ReadRTP(); err != nil {
+					return
+				}
+			}
+		}()
+	})
+
+	if err = negotiateWHEP(peerConnection, roomID, token); err != nil {
+		metrics.err = fmt.Errorf("negotiate WHEP: %w", err)
+		return metrics
+	}
+	metrics.connectLatency = time.Since(start)
+
+	select {
+	case <-firstRTP:
+		metrics.firstRTPLatency = time.Since(start) - metrics.connectLatency
+	case <-time.After(*testDuration):
+	}
+
+	// Hold the session open for the rest of testDuration, not a second full
+	// testDuration on top of the wait above, so subscribers stay attached for
+	// roughly the same window runRoom keeps the publisher connection open.
+	if remaining := *testDuration - time.Since(start); remaining > 0 {
+		time.Sleep(remaining)
+	}
+	packetsLost, jitter := sampleInboundStats(peerConnection)
+	metrics.packetsLost, metrics.jitter = packetsLost, jitter
+
+	return metrics
+}
+
+// negotiateWHIP drives the WHIP offer/answer handshake against the server's
+// /whip/:room/:user endpoint.
+func negotiateWHIP(peerConnection *webrtc.PeerConnection, roomID, token string) error {
+	return negotiate(peerConnection, fmt.Sprintf("%s/whip/%s/%s", *serverURL, roomID, uuid.New().String()), token)
+}
+
+// negotiateWHEP drives the WHEP offer/answer handshake against the server's
+// /whep/:room/:user endpoint.
+func negotiateWHEP(peerConnection *webrtc.PeerConnection, roomID, token string) error {
+	return negotiate(peerConnection, fmt.Sprintf("%s/whep/%s/%s", *serverURL, roomID, uuid.New().String()), token)
+}
+
+func negotiate(peerConnection *webrtc.PeerConnection, url, token string) error {
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gatherComplete
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(peerConnection.LocalDescription().SDP))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint: errcheck
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	answer, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(answer),
+	})
+}
+
+// fetchToken requests a bearer token scoped to roomID/role from the
+// server's token issuance endpoint, authenticating as a trusted issuer with
+// -token-issuer-secret (must match the server's TOKEN_ISSUER_SECRET).
+func fetchToken(roomID, role string) (string, error) {
+	url := fmt.Sprintf("%s/room/%s/token?role=%s", *serverURL, roomID, role)
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Token-Issuer-Secret", *issuerSecret)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close() //nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return body.Token, nil
+}
+
+// sampleInboundStats reads the most recently reported packet loss/jitter
+// across every inbound RTP stream on the connection.
+func sampleInboundStats(peerConnection *webrtc.PeerConnection) (packetsLost int64, jitter float64) {
+	for _, stat := range peerConnection.GetStats() {
+		inbound, ok := stat.(webrtc.InboundRTPStreamStats)
+		if !ok {
+			continue
+		}
+		packetsLost += inbound.PacketsLost
+		jitter += inbound.Jitter
+	}
+	return packetsLost, jitter
+}
+
+// report prints aggregated connect/RTP latency, packet loss, and jitter
+// across every session once all rooms have finished.
+func report(results <-chan sessionMetrics) {
+	var (
+		total, failed                          int64
+		publishCount, subscribeCount           int64
+		publishConnectSum, subscribeConnectSum time.Duration
+		firstRTPSum                            time.Duration
+		firstRTPCount, packetsLostSum          int64
+		jitterSum                              float64
+	)
+
+	for metrics := range results {
+		total++
+		if metrics.err != nil {
+			failed++
+			log.Printf("%s session failed: %s", metrics.kind, metrics.err)
+			continue
+		}
+
+		if metrics.kind == "publish" {
+			publishCount++
+			publishConnectSum += metrics.connectLatency
+		} else {
+			subscribeCount++
+			subscribeConnectSum += metrics.connectLatency
+			if metrics.firstRTPLatency > 0 {
+				firstRTPSum += metrics.firstRTPLatency
+				firstRTPCount++
+			}
+			packetsLostSum += metrics.packetsLost
+			jitterSum += metrics.jitter
+		}
+	}
+
+	succeeded := total - failed
+	fmt.Printf("sessions: %d total, %d succeeded, %d failed\n", total, succeeded, failed)
+	if publishCount > 0 {
+		fmt.Printf("avg publisher connect time: %s\n", divDuration(publishConnectSum, publishCount))
+	}
+	if subscribeCount > 0 {
+		fmt.Printf("avg subscriber connect time: %s\n", divDuration(subscribeConnectSum, subscribeCount))
+	}
+	if firstRTPCount > 0 {
+		fmt.Printf("avg first-RTP latency: %s\n", divDuration(firstRTPSum, firstRTPCount))
+	}
+	fmt.Printf("total packets lost: %d\n", packetsLostSum)
+	fmt.Printf("total jitter: %.2f\n", jitterSum)
+
+	lastReportSucceeded.Store(succeeded)
+	lastReportFailed.Store(failed)
+}
+
+func divDuration(total time.Duration, n int64) time.Duration {
+	if n == 0 {
+		return 0
+	}
+	return total / time.Duration(n)
+}
+
+// lastReportSucceeded/lastReportFailed back the Prometheus gauges served by
+// serveMetrics, since the run's final counts aren't known until report runs.
+// nolint: gochecknoglobals
+var (
+	lastReportSucceeded atomic.Int64
+	lastReportFailed    atomic.Int64
+)
+
+// serveMetrics exposes a minimal Prometheus text-format endpoint so a
+// scraper can record the outcome of this run without pulling in a metrics
+// client library for a one-shot load test tool.
+func serveMetrics(addr string) {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE loadgen_sessions_succeeded gauge\nloadgen_sessions_succeeded %d\n", lastReportSucceeded.Load())
+		fmt.Fprintf(w, "# TYPE loadgen_sessions_failed gauge\nloadgen_sessions_failed %d\n", lastReportFailed.Load())
+	})
+	if err := http.ListenAndServe(addr, nil); err != nil { //nolint: gosec
+		log.Printf("metrics server stopped: %s", err)
+	}
+}
@@ -9,21 +9,50 @@ package main
 
 import (
 	"bytes"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"github.com/google/uuid"
 	ice "github.com/pion/ice/v4"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/pion/interceptor"
 	"github.com/pion/interceptor/pkg/intervalpli"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
 	webrtc "github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
 )
 
+// trickleAcceptPatch is the Accept-Patch value we advertise/require for
+// RFC 9725 trickle ICE over PATCH with a trickle-ice-sdpfrag body.
+const trickleAcceptPatch = "application/trickle-ice-sdpfrag"
+
+// recordingsDir is the base directory recordings are written under, one
+// subdirectory per room.
+const recordingsDir = "recordings"
+
+// validRoomID reports whether roomID is safe to use as a single path segment
+// under recordingsDir. Room ids come straight from the URL, so without this
+// check a room id of ".." (or containing a "/") would let newRoomRecorder and
+// roomRecordingsHandler read or write outside recordingsDir entirely.
+func validRoomID(roomID string) bool {
+	return roomID != "" && roomID != "." && roomID != ".." && !strings.ContainsAny(roomID, `/\`)
+}
+
 // nolint: gochecknoglobals
 var (
 	peerConnectionConfiguration = webrtc.Configuration{
@@ -36,7 +65,195 @@ var (
 )
 
 var settingEngine *webrtc.SettingEngine
-var api *webrtc.API
+
+// allowedMimeTypes is the codec allowlist we are willing to negotiate. Each
+// PeerConnection's MediaEngine is populated from the intersection of this
+// set with whatever the offerer actually proposed, instead of a single
+// hardcoded codec.
+// nolint: gochecknoglobals
+var allowedMimeTypes = map[string]string{
+	"vp8":  webrtc.MimeTypeVP8,
+	"vp9":  webrtc.MimeTypeVP9,
+	"h264": webrtc.MimeTypeH264,
+	"av1":  webrtc.MimeTypeAV1,
+	"opus": webrtc.MimeTypeOpus,
+	"g722": webrtc.MimeTypeG722,
+}
+
+const (
+	rolePublish   = "publish"
+	roleSubscribe = "subscribe"
+	tokenTTL      = 12 * time.Hour
+)
+
+// roomClaims binds a bearer token to one room and one role, so a token
+// issued for subscribing can't be replayed to publish and vice versa.
+type roomClaims struct {
+	Room string `json:"room"`
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// authConfig holds the key material used to sign and verify WHIP/WHEP
+// bearer tokens. The algorithm and keys are configured via env vars so
+// deployments can choose HS256 (shared secret) or RS256 (key pair) without
+// a code change.
+type authConfig struct {
+	alg        string
+	hmacSecret []byte
+	rsaPrivate *rsa.PrivateKey
+	rsaPublic  *rsa.PublicKey
+}
+
+var auth authConfig
+
+func init() {
+	var err error
+	if auth, err = loadAuthConfig(); err != nil {
+		panic(err)
+	}
+}
+
+func loadAuthConfig() (authConfig, error) {
+	cfg := authConfig{alg: os.Getenv("JWT_ALG")}
+	if cfg.alg == "" {
+		cfg.alg = "HS256"
+	}
+
+	switch cfg.alg {
+	case "HS256":
+		secret := os.Getenv("JWT_HMAC_SECRET")
+		if secret == "" {
+			secret = "insecure-development-secret"
+		}
+		cfg.hmacSecret = []byte(secret)
+	case "RS256":
+		keyPEM, err := os.ReadFile(os.Getenv("JWT_RSA_PRIVATE_KEY_FILE"))
+		if err != nil {
+			return authConfig{}, err
+		}
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return authConfig{}, fmt.Errorf("JWT_RSA_PRIVATE_KEY_FILE does not contain a PEM block")
+		}
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return authConfig{}, err
+		}
+		cfg.rsaPrivate = key
+		cfg.rsaPublic = &key.PublicKey
+	default:
+		return authConfig{}, fmt.Errorf("unsupported JWT_ALG %q, want HS256 or RS256", cfg.alg)
+	}
+	return cfg, nil
+}
+
+func (a authConfig) issueToken(room, role string) (string, error) {
+	claims := roomClaims{
+		Room: room,
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenTTL)),
+		},
+	}
+
+	if a.alg == "RS256" {
+		return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(a.rsaPrivate)
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.hmacSecret)
+}
+
+func (a authConfig) verifyToken(tokenString string) (*roomClaims, error) {
+	claims := &roomClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if a.alg == "RS256" {
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+			}
+			return a.rsaPublic, nil
+		}
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return a.hmacSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// tokenIssuerSecretHeader carries the shared secret that authorizes a caller
+// to mint WHIP/WHEP bearer tokens. Without it, tokenHandler would let anyone
+// who knows a room id issue themselves a publish or subscribe token, making
+// the JWT/ACL scheme cosmetic.
+const tokenIssuerSecretHeader = "X-Token-Issuer-Secret"
+
+// requireTokenIssuerSecret gates token issuance behind TOKEN_ISSUER_SECRET, a
+// secret shared with whatever trusted backend is allowed to mint tokens on a
+// caller's behalf (end users should never call tokenHandler directly).
+func requireTokenIssuerSecret() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret := os.Getenv("TOKEN_ISSUER_SECRET")
+		if secret == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "token issuance is disabled: TOKEN_ISSUER_SECRET is not configured"})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader(tokenIssuerSecretHeader)), []byte(secret)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or missing " + tokenIssuerSecretHeader})
+			return
+		}
+	}
+}
+
+// requireBearerToken gates a WHIP/WHEP route behind a JWT whose claims bind
+// it to the room in the URL and the given role.
+func requireBearerToken(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if tokenString == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
+			return
+		}
+
+		claims, err := auth.verifyToken(tokenString)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		if claims.Room != c.Param("room") || claims.Role != role {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token not valid for this room/role"})
+			return
+		}
+	}
+}
+
+// tokenHandler issues a bearer token scoped to one room and role:
+// POST /room/:room/token?role=publish|subscribe.
+func tokenHandler(c *gin.Context) {
+	room := struct {
+		Room string `uri:"room" binding:"required"`
+	}{}
+	if err := c.ShouldBindUri(&room); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	role := c.Query("role")
+	if role != rolePublish && role != roleSubscribe {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `role must be "publish" or "subscribe"`})
+		return
+	}
+
+	token, err := auth.issueToken(room.Room, role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"token": token})
+}
 
 func init() {
 	// Create a SettingEngine, this allows non-standard WebRTC behavior
@@ -73,27 +290,14 @@ func init() {
 	}
 }
 
-func init() {
-	var err error
-	err, api = prepareEngine()
+// apiForOffer builds a fresh *webrtc.API for a single PeerConnection, with a
+// MediaEngine populated from the codecs the offerer actually proposed. This
+// replaces reusing one global *webrtc.API, which meant every PeerConnection
+// shared (and could race on) the same MediaEngine/InterceptorRegistry.
+func apiForOffer(offer []byte) (*webrtc.API, error) {
+	mediaEngine, err := mediaEngineForOffer(offer)
 	if err != nil {
-		panic(err)
-	}
-}
-
-func prepareEngine() (error, *webrtc.API) {
-	mediaEngine := &webrtc.MediaEngine{}
-
-	// Setup the codecs you want to use.
-	// We'll only use H264 but you can also define your own
-	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1",
-			RTCPFeedback: nil,
-		},
-		PayloadType: 111,
-	}, webrtc.RTPCodecTypeAudio); err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Create a InterceptorRegistry. This is the user configurable RTP/RTCP Pipeline.
@@ -108,33 +312,489 @@ func prepareEngine() (error, *webrtc.API) {
 	// A real world application should process incoming RTCP packets from viewers and forward them to senders
 	intervalPliFactory, err := intervalpli.NewReceiverInterceptor()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	interceptorRegistry.Add(intervalPliFactory)
 
-	// Use the default set of Interceptors
+	// Use the default set of Interceptors. RegisterDefaultInterceptors adds
+	// NACK and transport-cc feedback to the codecs we just registered and
+	// wires up the matching NACK/TWCC interceptors, on top of whatever rtcp-fb
+	// lines mediaEngineForOffer copied from the offer.
 	if err = webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	// Create the API object with the MediaEngine
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine),
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine),
 		webrtc.WithSettingEngine(*settingEngine),
-		webrtc.WithInterceptorRegistry(interceptorRegistry))
-	return err, api
+		webrtc.WithInterceptorRegistry(interceptorRegistry)), nil
 }
 
-var mapOfTracks = make(map[string]*webrtc.TrackLocalStaticRTP)
+// mediaEngineForOffer registers the intersection of allowedMimeTypes with
+// what the offer proposes, preserving the offerer's payload types and
+// rtcp-fb lines instead of assuming a fixed codec/PT like 111/Opus.
+func mediaEngineForOffer(offer []byte) (*webrtc.MediaEngine, error) {
+	offeredCodecs, err := parseOfferedCodecs(offer)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaEngine := &webrtc.MediaEngine{}
+	for _, codec := range offeredCodecs {
+		mimeType, ok := allowedMimeTypes[strings.ToLower(codec.name)]
+		if !ok {
+			continue
+		}
+		if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     mimeType,
+				ClockRate:    codec.clockRate,
+				Channels:     codec.channels,
+				SDPFmtpLine:  codec.fmtpLine,
+				RTCPFeedback: codec.rtcpFeedback,
+			},
+			PayloadType: webrtc.PayloadType(codec.payloadType),
+		}, codec.kind); err != nil {
+			return nil, err
+		}
+	}
+	return mediaEngine, nil
+}
+
+// offeredCodec is one payload type from an offer's m= line, with its
+// rtpmap/fmtp/rtcp-fb attributes collected alongside it.
+type offeredCodec struct {
+	payloadType  int
+	name         string
+	clockRate    uint32
+	channels     uint16
+	fmtpLine     string
+	rtcpFeedback []webrtc.RTCPFeedback
+	kind         webrtc.RTPCodecType
+}
+
+// parseOfferedCodecs walks every audio/video media section of offer and
+// returns one offeredCodec per payload type listed on its m= line, in the
+// order the offerer listed them. Payload types with no a=rtpmap attribute
+// (e.g. static types like 0/PCMU) are skipped.
+func parseOfferedCodecs(offer []byte) ([]offeredCodec, error) {
+	var parsed sdp.SessionDescription
+	if err := parsed.Unmarshal(offer); err != nil {
+		return nil, err
+	}
+
+	var codecs []offeredCodec
+	for _, media := range parsed.MediaDescriptions {
+		kind := webrtc.NewRTPCodecType(media.MediaName.Media)
+		if kind == 0 {
+			continue // e.g. application/data channel m= line
+		}
+
+		byPayloadType := make(map[int]*offeredCodec, len(media.MediaName.Formats))
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.Atoi(format)
+			if err != nil {
+				continue
+			}
+			byPayloadType[payloadType] = &offeredCodec{payloadType: payloadType, kind: kind}
+		}
+
+		for _, attr := range media.Attributes {
+			fields := strings.SplitN(attr.Value, " ", 2)
+			payloadType, err := strconv.Atoi(fields[0])
+			if err != nil || byPayloadType[payloadType] == nil {
+				continue
+			}
+			codec := byPayloadType[payloadType]
+
+			switch attr.Key {
+			case "rtpmap":
+				if len(fields) < 2 {
+					continue
+				}
+				nameAndRate := strings.Split(fields[1], "/")
+				codec.name = nameAndRate[0]
+				if len(nameAndRate) > 1 {
+					if rate, parseErr := strconv.ParseUint(nameAndRate[1], 10, 32); parseErr == nil {
+						codec.clockRate = uint32(rate)
+					}
+				}
+				if len(nameAndRate) > 2 {
+					if channels, parseErr := strconv.ParseUint(nameAndRate[2], 10, 16); parseErr == nil {
+						codec.channels = uint16(channels)
+					}
+				} else if kind == webrtc.RTPCodecTypeAudio {
+					codec.channels = 1
+				}
+			case "fmtp":
+				if len(fields) < 2 {
+					continue
+				}
+				codec.fmtpLine = fields[1]
+			case "rtcp-fb":
+				if len(fields) < 2 {
+					continue
+				}
+				feedback := strings.SplitN(fields[1], " ", 2)
+				rtcpFeedback := webrtc.RTCPFeedback{Type: feedback[0]}
+				if len(feedback) > 1 {
+					rtcpFeedback.Parameter = feedback[1]
+				}
+				codec.rtcpFeedback = append(codec.rtcpFeedback, rtcpFeedback)
+			}
+		}
 
-func MakeAndHoldVideoTrack(id string) *webrtc.TrackLocalStaticRTP {
-	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
-		MimeType: webrtc.MimeTypeOpus,
-	}, "audio", "pion")
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.Atoi(format)
+			if err != nil || byPayloadType[payloadType].name == "" {
+				continue
+			}
+			codecs = append(codecs, *byPayloadType[payloadType])
+		}
+	}
+	return codecs, nil
+}
+
+// offeredKinds reports which media kinds an offer proposed, so callers can
+// tell whether it's safe to request a transceiver for a given kind without
+// re-deriving it from the raw SDP themselves.
+func offeredKinds(offer []byte) (map[webrtc.RTPCodecType]bool, error) {
+	codecs, err := parseOfferedCodecs(offer)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	kinds := make(map[webrtc.RTPCodecType]bool, 2)
+	for _, codec := range codecs {
+		kinds[codec.kind] = true
+	}
+	return kinds, nil
+}
+
+// Room owns the published tracks and subscriber PeerConnections for a single
+// WHIP broadcaster. A room has at most one active publisher, but any number
+// of WHEP subscribers can attach to its audio/video tracks, which is why
+// lookups below are keyed by room only and never by the publisher's user id.
+type Room struct {
+	mu          sync.Mutex
+	audioTrack  *webrtc.TrackLocalStaticRTP
+	videoTrack  *webrtc.TrackLocalStaticRTP
+	subscribers map[string]*webrtc.PeerConnection
+	publisher   *session
+	recorder    *roomRecorder
+}
+
+// roomRecorder writes a room's published ingest to disk: video to an IVF
+// file, audio to an Ogg file. Writers are created lazily on the first
+// packet of their kind so a room with no video never creates an empty IVF
+// file, and vice versa.
+type roomRecorder struct {
+	mu  sync.Mutex
+	dir string
+	ivf *ivfwriter.IVFWriter
+	ogg *oggwriter.OggWriter
+}
+
+func newRoomRecorder(roomID string) (*roomRecorder, error) {
+	if !validRoomID(roomID) {
+		return nil, fmt.Errorf("invalid room id %q", roomID)
+	}
+	dir := filepath.Join(recordingsDir, roomID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &roomRecorder{dir: dir}, nil
+}
+
+// write dispatches pkt to the IVF or Ogg writer based on the publisher's
+// negotiated codec, creating the writer on first use.
+func (rec *roomRecorder) write(mimeType string, pkt *rtp.Packet) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8), strings.EqualFold(mimeType, webrtc.MimeTypeVP9), strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		if rec.ivf == nil {
+			writer, err := ivfwriter.New(filepath.Join(rec.dir, fmt.Sprintf("video-%d.ivf", time.Now().UnixNano())))
+			if err != nil {
+				return err
+			}
+			rec.ivf = writer
+		}
+		return rec.ivf.WriteRTP(pkt)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+		if rec.ogg == nil {
+			writer, err := oggwriter.New(filepath.Join(rec.dir, fmt.Sprintf("audio-%d.ogg", time.Now().UnixNano())), 48000, 2)
+			if err != nil {
+				return err
+			}
+			rec.ogg = writer
+		}
+		return rec.ogg.WriteRTP(pkt)
+	default:
+		return nil
+	}
+}
+
+// rotate closes any open writers so the next written packet starts a fresh
+// pair of files, used when a publisher reconnects.
+func (rec *roomRecorder) rotate() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.ivf != nil {
+		_ = rec.ivf.Close()
+		rec.ivf = nil
+	}
+	if rec.ogg != nil {
+		_ = rec.ogg.Close()
+		rec.ogg = nil
+	}
+}
+
+func (r *Room) trackForKind(kind webrtc.RTPCodecType) *webrtc.TrackLocalStaticRTP {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if kind == webrtc.RTPCodecTypeAudio {
+		return r.audioTrack
+	}
+	return r.videoTrack
+}
+
+// trackFor returns the local track this room forwards remoteTrack's packets
+// on, creating it lazily from the publisher's negotiated codec so we stop
+// assuming every published track is Opus audio.
+func (r *Room) trackFor(remoteTrack *webrtc.TrackRemote) (*webrtc.TrackLocalStaticRTP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if remoteTrack.Kind() == webrtc.RTPCodecTypeAudio {
+		if r.audioTrack != nil {
+			return r.audioTrack, nil
+		}
+	} else if r.videoTrack != nil {
+		return r.videoTrack, nil
+	}
+
+	localTrack, err := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, remoteTrack.Kind().String(), "pion")
+	if err != nil {
+		return nil, err
+	}
+
+	if remoteTrack.Kind() == webrtc.RTPCodecTypeAudio {
+		r.audioTrack = localTrack
+	} else {
+		r.videoTrack = localTrack
+	}
+	return localTrack, nil
+}
+
+// enableRecording creates the room's recorder on first use and rotates its
+// writers so a reconnecting publisher always starts a fresh pair of files.
+func (r *Room) enableRecording(roomID string) error {
+	r.mu.Lock()
+	recorder := r.recorder
+	r.mu.Unlock()
+
+	if recorder == nil {
+		var err error
+		if recorder, err = newRoomRecorder(roomID); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.recorder = recorder
+		r.mu.Unlock()
+		return nil
+	}
+
+	recorder.rotate()
+	return nil
+}
+
+func (r *Room) recordPacket(mimeType string, pkt *rtp.Packet) {
+	r.mu.Lock()
+	recorder := r.recorder
+	r.mu.Unlock()
+	if recorder == nil {
+		return
+	}
+	if err := recorder.write(mimeType, pkt); err != nil {
+		fmt.Printf("failed to write recording packet: %s\n", err)
+	}
+}
+
+func (r *Room) closeRecording() {
+	r.mu.Lock()
+	recorder := r.recorder
+	r.mu.Unlock()
+	if recorder != nil {
+		recorder.rotate()
+	}
+}
+
+// tryClaimPublisher atomically claims the room's single publisher slot,
+// enforcing that only one live publisher exists per room. It returns false
+// if another publisher already holds the slot.
+func (r *Room) tryClaimPublisher(sess *session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.publisher != nil {
+		return false
+	}
+	r.publisher = sess
+	return true
+}
+
+// isPublisher reports whether sess currently holds the room's publisher slot.
+func (r *Room) isPublisher(sess *session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.publisher == sess
+}
+
+// addSubscriber registers a WHEP PeerConnection so it can be torn down when
+// the publisher leaves.
+func (r *Room) addSubscriber(sessionID string, peerConnection *webrtc.PeerConnection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscribers[sessionID] = peerConnection
+}
+
+func (r *Room) removeSubscriber(sessionID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.subscribers, sessionID)
+}
+
+// close tears the room down: every subscriber PeerConnection is closed and
+// the published tracks are dropped so a new publisher starts from a clean
+// slate. r.recorder is also cleared, since recording is opt-in per publish
+// ("?record=true") and must not carry over to whoever publishes next.
+func (r *Room) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, subscriber := range r.subscribers {
+		_ = subscriber.Close()
+		delete(r.subscribers, id)
 	}
-	mapOfTracks[id] = track
-	return track
+	r.audioTrack = nil
+	r.videoTrack = nil
+	r.publisher = nil
+	r.recorder = nil
+}
+
+var roomsMu sync.Mutex
+var rooms = make(map[string]*Room)
+
+func getOrCreateRoom(roomID string) *Room {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	room, ok := rooms[roomID]
+	if !ok {
+		room = &Room{subscribers: make(map[string]*webrtc.PeerConnection)}
+		rooms[roomID] = room
+	}
+	return room
+}
+
+// session is the resource a WHIP/WHEP POST creates. It is addressable at
+// Location and can be torn down (DELETE) or fed additional ICE candidates
+// (PATCH) without re-negotiating the whole SDP.
+type session struct {
+	id             string
+	resourcePath   string
+	peerConnection *webrtc.PeerConnection
+	room           *Room
+	roomID, user   string
+
+	mu               sync.Mutex
+	trickle          bool
+	pendingLocalCand []string
+}
+
+var sessionsMu sync.Mutex
+var sessions = make(map[string]*session)
+
+func newSession(resourcePath, roomID, user string, room *Room, peerConnection *webrtc.PeerConnection) *session {
+	sess := &session{
+		id:             uuid.New().String(),
+		resourcePath:   resourcePath,
+		peerConnection: peerConnection,
+		room:           room,
+		roomID:         roomID,
+		user:           user,
+	}
+	sessionsMu.Lock()
+	sessions[sess.id] = sess
+	sessionsMu.Unlock()
+	return sess
+}
+
+func getSession(id string) (*session, bool) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	sess, ok := sessions[id]
+	return sess, ok
+}
+
+func (s *session) delete() {
+	sessionsMu.Lock()
+	delete(sessions, s.id)
+	sessionsMu.Unlock()
+}
+
+// location is the RFC 9725 resource URL returned in the Location header,
+// uniquely identifying this session instead of the static "/whip" path.
+func (s *session) location() string {
+	return fmt.Sprintf("/%s/%s/%s/%s", s.resourcePath, s.roomID, s.user, s.id)
+}
+
+// addLocalCandidate buffers a server-gathered ICE candidate so it can be
+// handed back to the client. HTTP gives us no way to push to the client on
+// our own, so we piggyback these onto the body of the client's next PATCH
+// response instead of a true server-initiated PATCH.
+func (s *session) addLocalCandidate(candidate *webrtc.ICECandidate) {
+	if candidate == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pendingLocalCand = append(s.pendingLocalCand, "a="+candidate.ToJSON().Candidate)
+}
+
+// drainLocalCandidates returns and clears the candidates gathered since the
+// last call, formatted as a trickle-ice-sdpfrag body.
+func (s *session) drainLocalCandidates() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pendingLocalCand) == 0 {
+		return ""
+	}
+	frag := strings.Join(s.pendingLocalCand, "\r\n") + "\r\n"
+	s.pendingLocalCand = nil
+	return frag
+}
+
+// parseTrickleICESDPFrag extracts remote ICE candidates (and whether the
+// fragment signals end-of-candidates) from an application/trickle-ice-sdpfrag
+// body, tracking the current m= section's mid so candidates are attributed
+// to the right media section.
+func parseTrickleICESDPFrag(body string) (candidates []webrtc.ICECandidateInit, endOfCandidates bool) {
+	var mid string
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			sdpMid := mid
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    &sdpMid,
+			})
+		case strings.HasPrefix(line, "a=end-of-candidates"):
+			endOfCandidates = true
+		}
+	}
+	return candidates, endOfCandidates
 }
 
 type Query struct {
@@ -142,11 +802,19 @@ type Query struct {
 	User string `uri:"user" binding:"required"`
 }
 
+// SessionQuery additionally binds the session id path segment used by the
+// DELETE/PATCH resource handlers.
+type SessionQuery struct {
+	Room    string `uri:"room" binding:"required"`
+	User    string `uri:"user" binding:"required"`
+	Session string `uri:"session" binding:"required"`
+}
+
 type RoomId string
 
 type User string
 
-type Room struct {
+type RoomInvite struct {
 	Caller User `json:"callerId"`
 	Callee User `json:"calleeId"`
 }
@@ -166,7 +834,7 @@ func (w bodyLogWriter) Write(b []byte) (int, error) {
 }
 
 var mutex sync.Mutex
-var cache = make(map[RoomId]Room)
+var cache = make(map[RoomId]RoomInvite)
 
 // nolint:gocognit
 func main() {
@@ -194,8 +862,14 @@ func main() {
 	r.POST("/room/create", createRoomHandler)
 	r.POST("/room/:room/init", initRoomHandler)
 	r.POST("/room/:room", getRoomHandler)
-	r.POST("/whep/:room/:user", whepHandler)
-	r.POST("/whip/:room/:user", whipHandler)
+	r.GET("/room/:room/recordings", requireBearerToken(rolePublish), roomRecordingsHandler)
+	r.POST("/room/:room/token", requireTokenIssuerSecret(), tokenHandler)
+	r.POST("/whep/:room/:user", requireBearerToken(roleSubscribe), whepHandler)
+	r.POST("/whip/:room/:user", requireBearerToken(rolePublish), whipHandler)
+	r.DELETE("/whep/:room/:user/:session", sessionDeleteHandler)
+	r.DELETE("/whip/:room/:user/:session", sessionDeleteHandler)
+	r.PATCH("/whep/:room/:user/:session", sessionPatchHandler)
+	r.PATCH("/whip/:room/:user/:session", sessionPatchHandler)
 
 	fmt.Println("Open http://localhost:8080 to access this demo")
 	panic(r.Run("0.0.0.0:8080"))
@@ -219,6 +893,39 @@ func getRoomHandler(c *gin.Context) {
 	return
 }
 
+// roomRecordingsHandler lists the recording files produced for a room,
+// if any were made by enabling "?record=true" on a WHIP POST.
+func roomRecordingsHandler(c *gin.Context) {
+	room := struct {
+		Room string `uri:"room" binding:"required"`
+	}{}
+	if err := c.ShouldBindUri(&room); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validRoomID(room.Room) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid room id"})
+		return
+	}
+
+	entries, err := os.ReadDir(filepath.Join(recordingsDir, room.Room))
+	if os.IsNotExist(err) {
+		c.JSON(http.StatusOK, gin.H{"recordings": []string{}})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files = append(files, entry.Name())
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"recordings": files})
+}
+
 func createRoomHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"room": uuid.New().String()})
 	return
@@ -235,7 +942,7 @@ func initRoomHandler(c *gin.Context) {
 		return
 	}
 	caller, callee := User(uuid.New().String()), User(uuid.New().String())
-	cache[RoomId(room.Room)] = Room{
+	cache[RoomId(room.Room)] = RoomInvite{
 		Caller: caller,
 		Callee: callee,
 	}
@@ -258,46 +965,90 @@ func whipHandler(c *gin.Context) {
 		panic(err)
 	}
 
-	// Create a MediaEngine object to configure the supported codec
-	err, api = prepareEngine()
+	room := getOrCreateRoom(query.Room)
+
+	if c.Query("record") == "true" {
+		if err = room.enableRecording(query.Room); err != nil {
+			panic(err)
+		}
+	}
+
+	peerAPI, err := apiForOffer(offer)
 	if err != nil {
 		panic(err)
 	}
 
-	// Prepare the configuration
-
 	// Create a new RTCPeerConnection
-	peerConnection, err := api.NewPeerConnection(peerConnectionConfiguration)
+	peerConnection, err := peerAPI.NewPeerConnection(peerConnectionConfiguration)
 	if err != nil {
 		panic(err)
 	}
 
-	// Allow us to receive 1 video trac
-	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+	kinds, err := offeredKinds(offer)
+	if err != nil {
 		panic(err)
 	}
 
-	// Set a handler for when a new remote track starts, this handler saves buffers to disk as
-	// an ivf file, since we could have multiple video tracks we provide a counter.
-	// In your application this is where you would handle/process video
-	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) { //nolint: revive
-		for {
-			pkt, _, err := track.ReadRTP()
-			if err != nil {
-				panic(err)
-			}
+	// Allow us to receive an audio and/or video track from the publisher, but
+	// only for kinds the offer actually proposed. AddTransceiverFromKind needs
+	// at least one registered codec for the kind, which mediaEngineForOffer
+	// won't have registered if the offerer never sent it (e.g. a video-only
+	// publisher with no microphone).
+	if kinds[webrtc.RTPCodecTypeAudio] {
+		if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+			panic(err)
+		}
+	}
+	if kinds[webrtc.RTPCodecTypeVideo] {
+		if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+			panic(err)
+		}
+	}
 
-			if _, ok := mapOfTracks[query.String()]; !ok {
-				MakeAndHoldVideoTrack(query.String())
+	// Forward every packet we receive from the publisher to the room's local
+	// track for that media kind, so every WHEP subscriber attached to the
+	// room picks it up.
+	peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) { //nolint: revive
+		localTrack, trackErr := room.trackFor(remoteTrack)
+		if trackErr != nil {
+			panic(trackErr)
+		}
+
+		mimeType := remoteTrack.Codec().MimeType
+		for {
+			pkt, _, readErr := remoteTrack.ReadRTP()
+			if readErr != nil {
+				return
 			}
-			if err = mapOfTracks[query.String()].WriteRTP(pkt); err != nil {
-				panic(err)
+			if writeErr := localTrack.WriteRTP(pkt); writeErr != nil {
+				return
 			}
+			room.recordPacket(mimeType, pkt)
+		}
+	})
+
+	sess := newSession("whip", query.Room, query.User, room, peerConnection)
+	if !room.tryClaimPublisher(sess) {
+		_ = peerConnection.Close()
+		sess.delete()
+		c.JSON(http.StatusConflict, gin.H{"error": "room already has an active publisher"})
+		return
+	}
+
+	// When the publisher goes away, tear the room down so subscribers
+	// disconnect and the next publisher starts from a clean room.
+	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		fmt.Printf("ICE Connection State has changed: %s\n", connectionState.String())
+		if connectionState == webrtc.ICEConnectionStateFailed || connectionState == webrtc.ICEConnectionStateDisconnected || connectionState == webrtc.ICEConnectionStateClosed {
+			_ = peerConnection.Close()
+			room.closeRecording()
+			room.close()
+			sess.delete()
 		}
 	})
 
 	// Send answer via HTTP Response
-	writeAnswer(c, peerConnection, offer, "/whip")
+	writeAnswer(c, sess, offer)
 }
 
 func whepHandler(c *gin.Context) {
@@ -311,61 +1062,99 @@ func whepHandler(c *gin.Context) {
 		panic(err)
 	}
 
+	room := getOrCreateRoom(query.Room)
+
+	peerAPI, err := apiForOffer(offer)
+	if err != nil {
+		panic(err)
+	}
+
 	// Create a new RTCPeerConnection
-	peerConnection, err := api.NewPeerConnection(peerConnectionConfiguration)
+	peerConnection, err := peerAPI.NewPeerConnection(peerConnectionConfiguration)
 	if err != nil {
 		panic(err)
 	}
 
-	// Add Video Track that is being written to from WHIP Session
-	for i := 0; i < 10 && mapOfTracks[query.String()] == nil; i++ {
+	// Wait for the room's publisher to show up. We subscribe to the room,
+	// not to a specific user id, so any number of WHEP viewers can attach
+	// to the same broadcast.
+	var audioTrack, videoTrack *webrtc.TrackLocalStaticRTP
+	for i := 0; i < 10; i++ {
+		audioTrack = room.trackForKind(webrtc.RTPCodecTypeAudio)
+		videoTrack = room.trackForKind(webrtc.RTPCodecTypeVideo)
+		if audioTrack != nil || videoTrack != nil {
+			break
+		}
 		time.Sleep(1 * time.Second)
 	}
-	if mapOfTracks[query.String()] == nil {
+	if audioTrack == nil && videoTrack == nil {
 		c.Status(http.StatusNotFound)
 		return
 	}
-	rtpSender, err := peerConnection.AddTrack(mapOfTracks[query.String()])
-	if err != nil {
-		panic(err)
-	}
 
-	// Read incoming RTCP packets
-	// Before these packets are returned they are processed by interceptors. For things
-	// like NACK this needs to be called.
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
-				return
-			}
+	for _, track := range []*webrtc.TrackLocalStaticRTP{audioTrack, videoTrack} {
+		if track == nil {
+			continue
+		}
+		rtpSender, addErr := peerConnection.AddTrack(track)
+		if addErr != nil {
+			panic(addErr)
 		}
-	}()
 
-	// Send answer via HTTP Response
-	writeAnswer(c, peerConnection, offer, "/whep")
-}
+		// Read incoming RTCP packets
+		// Before these packets are returned they are processed by interceptors. For things
+		// like NACK this needs to be called.
+		go func() {
+			rtcpBuf := make([]byte, 1500)
+			for {
+				if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+					return
+				}
+			}
+		}()
+	}
 
-func writeAnswer(c *gin.Context, peerConnection *webrtc.PeerConnection, offer []byte, path string) {
-	// Set the handler for ICE connection state
-	// This will notify you when the peer has connected/disconnected
+	sess := newSession("whep", query.Room, query.User, room, peerConnection)
+	room.addSubscriber(sess.id, peerConnection)
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		fmt.Printf("ICE Connection State has changed: %s\n", connectionState.String())
-
-		if connectionState == webrtc.ICEConnectionStateFailed {
+		if connectionState == webrtc.ICEConnectionStateFailed || connectionState == webrtc.ICEConnectionStateDisconnected || connectionState == webrtc.ICEConnectionStateClosed {
 			_ = peerConnection.Close()
+			room.removeSubscriber(sess.id)
+			sess.delete()
 		}
 	})
 
+	// Send answer via HTTP Response
+	writeAnswer(c, sess, offer)
+}
+
+// writeAnswer completes the offer/answer exchange and writes the answer SDP
+// as the HTTP response. Callers are expected to have already registered an
+// OnICEConnectionStateChange handler, since PeerConnection only keeps the
+// most recently registered one.
+func writeAnswer(c *gin.Context, sess *session, offer []byte) {
+	peerConnection := sess.peerConnection
+
+	// A client tells us it can trickle by advertising the sdpfrag media
+	// type it is prepared to PATCH/receive. When it does, we don't block
+	// on ICE gathering completing before answering.
+	sess.trickle = strings.Contains(c.GetHeader("Accept-Patch"), trickleAcceptPatch)
+
+	var gatherComplete <-chan struct{}
+	if !sess.trickle {
+		// Create channel that is blocked until ICE Gathering is complete
+		gatherComplete = webrtc.GatheringCompletePromise(peerConnection)
+	} else {
+		peerConnection.OnICECandidate(sess.addLocalCandidate)
+	}
+
 	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer, SDP: string(offer),
 	}); err != nil {
 		panic(err)
 	}
 
-	// Create channel that is blocked until ICE Gathering is complete
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-
 	// Create answer
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
@@ -374,15 +1163,92 @@ func writeAnswer(c *gin.Context, peerConnection *webrtc.PeerConnection, offer []
 		panic(err)
 	}
 
-	// Block until ICE Gathering is complete, disabling trickle ICE
-	// we do this because we only can exchange one signaling message
-	// in a production application you should exchange ICE Candidates via OnICECandidate
-	<-gatherComplete
+	if !sess.trickle {
+		// Block until ICE Gathering is complete, disabling trickle ICE
+		// we do this because we only can exchange one signaling message
+		// in a production application you should exchange ICE Candidates via OnICECandidate
+		<-gatherComplete
+	}
 
-	// WHIP+WHEP expects a Location header and a HTTP Status Code of 201
-	c.Header("Location", path)
+	// WHIP+WHEP expects a Location header and a HTTP Status Code of 201.
+	// Location now points at this session's own resource, not a shared
+	// static path, so it can be DELETEd/PATCHed independently of others.
+	c.Header("Location", sess.location())
+	if sess.trickle {
+		c.Header("Accept-Patch", trickleAcceptPatch)
+	}
 	c.Status(http.StatusCreated)
 
 	// Write Answer with Candidates as HTTP Response
 	c.String(http.StatusCreated, peerConnection.LocalDescription().SDP)
 }
+
+// sessionDeleteHandler implements the WHIP/WHEP session teardown resource:
+// DELETE /{whip,whep}/:room/:user/:session.
+func sessionDeleteHandler(c *gin.Context) {
+	var query SessionQuery
+	if err := c.ShouldBindUri(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sess, ok := getSession(query.Session)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if err := sess.peerConnection.Close(); err != nil {
+		panic(err)
+	}
+	sess.room.removeSubscriber(sess.id)
+	if sess.room.isPublisher(sess) {
+		sess.room.closeRecording()
+		sess.room.close()
+	}
+	sess.delete()
+
+	c.Status(http.StatusNoContent)
+}
+
+// sessionPatchHandler implements trickle ICE per RFC 9725/9726: the body is
+// an application/trickle-ice-sdpfrag containing "a=candidate:" and
+// "a=end-of-candidates" lines for the client's newly gathered candidates.
+// Any candidates we've gathered ourselves since the last PATCH are returned
+// in the response body, since HTTP gives us no other way to push them.
+func sessionPatchHandler(c *gin.Context) {
+	var query SessionQuery
+	if err := c.ShouldBindUri(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sess, ok := getSession(query.Session)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if c.ContentType() != trickleAcceptPatch {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "expected " + trickleAcceptPatch})
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		panic(err)
+	}
+
+	candidates, _ := parseTrickleICESDPFrag(string(body))
+	for _, candidate := range candidates {
+		if err := sess.peerConnection.AddICECandidate(candidate); err != nil {
+			panic(err)
+		}
+	}
+
+	if frag := sess.drainLocalCandidates(); frag != "" {
+		c.Data(http.StatusOK, trickleAcceptPatch, []byte(frag))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,217 @@
+// SPDX-License-Identifier: MIT
+
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"testing"
+
+	webrtc "github.com/pion/webrtc/v4"
+)
+
+func TestParseTrickleICESDPFrag(t *testing.T) {
+	cases := []struct {
+		name           string
+		body           string
+		wantCandidates []string
+		wantMids       []string
+		wantEnd        bool
+	}{
+		{
+			name:           "empty body",
+			body:           "",
+			wantCandidates: nil,
+			wantMids:       nil,
+		},
+		{
+			name: "single candidate after mid",
+			body: "a=mid:0\r\na=candidate:1 1 UDP 2122260223 192.168.0.1 5000 typ host\r\n",
+			wantCandidates: []string{
+				"candidate:1 1 UDP 2122260223 192.168.0.1 5000 typ host",
+			},
+			wantMids: []string{"0"},
+		},
+		{
+			name: "candidates attributed to the most recent mid",
+			body: "a=mid:0\r\n" +
+				"a=candidate:1 1 UDP 2122260223 192.168.0.1 5000 typ host\r\n" +
+				"a=mid:1\r\n" +
+				"a=candidate:2 1 UDP 2122260223 192.168.0.2 5001 typ host\r\n",
+			wantCandidates: []string{
+				"candidate:1 1 UDP 2122260223 192.168.0.1 5000 typ host",
+				"candidate:2 1 UDP 2122260223 192.168.0.2 5001 typ host",
+			},
+			wantMids: []string{"0", "1"},
+		},
+		{
+			name:           "candidate with no preceding mid has an empty SDPMid",
+			body:           "a=candidate:1 1 UDP 2122260223 192.168.0.1 5000 typ host\r\n",
+			wantCandidates: []string{"candidate:1 1 UDP 2122260223 192.168.0.1 5000 typ host"},
+			wantMids:       []string{""},
+		},
+		{
+			name:    "end-of-candidates with no candidates",
+			body:    "a=mid:0\r\na=end-of-candidates\r\n",
+			wantEnd: true,
+		},
+		{
+			name: "end-of-candidates alongside candidates",
+			body: "a=mid:0\r\na=candidate:1 1 UDP 2122260223 192.168.0.1 5000 typ host\r\na=end-of-candidates\r\n",
+			wantCandidates: []string{
+				"candidate:1 1 UDP 2122260223 192.168.0.1 5000 typ host",
+			},
+			wantMids: []string{"0"},
+			wantEnd:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			candidates, end := parseTrickleICESDPFrag(tc.body)
+			if end != tc.wantEnd {
+				t.Errorf("endOfCandidates = %v, want %v", end, tc.wantEnd)
+			}
+			if len(candidates) != len(tc.wantCandidates) {
+				t.Fatalf("got %d candidates, want %d: %+v", len(candidates), len(tc.wantCandidates), candidates)
+			}
+			for i, c := range candidates {
+				if c.Candidate != tc.wantCandidates[i] {
+					t.Errorf("candidate[%d] = %q, want %q", i, c.Candidate, tc.wantCandidates[i])
+				}
+				if c.SDPMid == nil {
+					t.Fatalf("candidate[%d].SDPMid is nil", i)
+				}
+				if *c.SDPMid != tc.wantMids[i] {
+					t.Errorf("candidate[%d].SDPMid = %q, want %q", i, *c.SDPMid, tc.wantMids[i])
+				}
+			}
+		})
+	}
+}
+
+const audioVideoOffer = `v=0
+o=- 0 0 IN IP4 127.0.0.1
+s=-
+t=0 0
+m=audio 9 UDP/TLS/RTP/SAVPF 111
+c=IN IP4 0.0.0.0
+a=mid:0
+a=rtpmap:111 opus/48000/2
+a=fmtp:111 minptime=10;useinbandfec=1
+a=rtcp-fb:111 transport-cc
+m=video 9 UDP/TLS/RTP/SAVPF 96
+c=IN IP4 0.0.0.0
+a=mid:1
+a=rtpmap:96 VP8/90000
+a=rtcp-fb:96 nack
+a=rtcp-fb:96 goog-remb
+`
+
+const videoOnlyOffer = `v=0
+o=- 0 0 IN IP4 127.0.0.1
+s=-
+t=0 0
+m=video 9 UDP/TLS/RTP/SAVPF 96
+c=IN IP4 0.0.0.0
+a=mid:0
+a=rtpmap:96 VP8/90000
+a=rtcp-fb:96 nack
+`
+
+// badPayloadTypeOffer has a non-numeric format on its m= line, which
+// strconv.Atoi rejects, so the section should parse with zero codecs
+// instead of erroring.
+const badPayloadTypeOffer = `v=0
+o=- 0 0 IN IP4 127.0.0.1
+s=-
+t=0 0
+m=audio 9 UDP/TLS/RTP/SAVPF foo
+c=IN IP4 0.0.0.0
+a=rtpmap:foo opus/48000/2
+`
+
+func TestParseOfferedCodecs(t *testing.T) {
+	t.Run("audio and video codecs with rtcp-fb and fmtp", func(t *testing.T) {
+		codecs, err := parseOfferedCodecs([]byte(audioVideoOffer))
+		if err != nil {
+			t.Fatalf("parseOfferedCodecs: %s", err)
+		}
+		if len(codecs) != 2 {
+			t.Fatalf("got %d codecs, want 2: %+v", len(codecs), codecs)
+		}
+
+		audio := codecs[0]
+		if audio.kind != webrtc.RTPCodecTypeAudio || audio.name != "opus" || audio.clockRate != 48000 || audio.channels != 2 {
+			t.Errorf("audio codec = %+v, want opus/48000/2 audio", audio)
+		}
+		if audio.fmtpLine != "minptime=10;useinbandfec=1" {
+			t.Errorf("audio fmtpLine = %q", audio.fmtpLine)
+		}
+		if len(audio.rtcpFeedback) != 1 || audio.rtcpFeedback[0].Type != "transport-cc" {
+			t.Errorf("audio rtcpFeedback = %+v", audio.rtcpFeedback)
+		}
+
+		video := codecs[1]
+		if video.kind != webrtc.RTPCodecTypeVideo || video.name != "VP8" || video.clockRate != 90000 {
+			t.Errorf("video codec = %+v, want VP8/90000 video", video)
+		}
+		if len(video.rtcpFeedback) != 2 {
+			t.Errorf("video rtcpFeedback = %+v, want 2 entries", video.rtcpFeedback)
+		}
+	})
+
+	t.Run("video-only offer yields no audio codecs", func(t *testing.T) {
+		codecs, err := parseOfferedCodecs([]byte(videoOnlyOffer))
+		if err != nil {
+			t.Fatalf("parseOfferedCodecs: %s", err)
+		}
+		for _, codec := range codecs {
+			if codec.kind == webrtc.RTPCodecTypeAudio {
+				t.Errorf("unexpected audio codec in video-only offer: %+v", codec)
+			}
+		}
+		if len(codecs) != 1 || codecs[0].kind != webrtc.RTPCodecTypeVideo {
+			t.Errorf("codecs = %+v, want exactly one video codec", codecs)
+		}
+	})
+
+	t.Run("non-numeric payload type is skipped, not an error", func(t *testing.T) {
+		codecs, err := parseOfferedCodecs([]byte(badPayloadTypeOffer))
+		if err != nil {
+			t.Fatalf("parseOfferedCodecs: %s", err)
+		}
+		if len(codecs) != 0 {
+			t.Errorf("codecs = %+v, want none", codecs)
+		}
+	})
+}
+
+func TestMediaEngineForOffer(t *testing.T) {
+	t.Run("video-only offer registers only video codecs", func(t *testing.T) {
+		mediaEngine, err := mediaEngineForOffer([]byte(videoOnlyOffer))
+		if err != nil {
+			t.Fatalf("mediaEngineForOffer: %s", err)
+		}
+		if codecs := mediaEngine.GetCodecsByKind(webrtc.RTPCodecTypeAudio); len(codecs) != 0 {
+			t.Errorf("got %d audio codecs registered for a video-only offer, want 0: %+v", len(codecs), codecs)
+		}
+		if codecs := mediaEngine.GetCodecsByKind(webrtc.RTPCodecTypeVideo); len(codecs) == 0 {
+			t.Errorf("got no video codecs registered for a video-only offer")
+		}
+	})
+
+	t.Run("audio and video offer registers both kinds", func(t *testing.T) {
+		mediaEngine, err := mediaEngineForOffer([]byte(audioVideoOffer))
+		if err != nil {
+			t.Fatalf("mediaEngineForOffer: %s", err)
+		}
+		if codecs := mediaEngine.GetCodecsByKind(webrtc.RTPCodecTypeAudio); len(codecs) == 0 {
+			t.Errorf("got no audio codecs registered")
+		}
+		if codecs := mediaEngine.GetCodecsByKind(webrtc.RTPCodecTypeVideo); len(codecs) == 0 {
+			t.Errorf("got no video codecs registered")
+		}
+	})
+}